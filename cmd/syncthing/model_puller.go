@@ -1,59 +1,191 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"os"
 	"path"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/calmh/syncthing/buffers"
 	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/files"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
 )
 
+// maxNodeFailures is how many bad blocks in a row we tolerate from a node
+// before we stop picking it to serve further requests.
+const maxNodeFailures = 3
+
+// maxOutstandingPerNode caps how many concurrent block requests we keep
+// in flight against any single node.
+const maxOutstandingPerNode = 4
+
+var errHashMismatch = errors.New("block hash mismatch")
+
 type requestResult struct {
-	node   string
-	file   scanner.File
-	path   string // full path name, fs-normalized
-	offset int64
-	data   []byte
-	err    error
+	node  string
+	file  scanner.File
+	path  string // full path name, fs-normalized
+	block scanner.Block
+	data  []byte
+	err   error
 }
 
 type openFile struct {
-	path         string // full path name, fs-normalized
-	temp         string // temporary filename, full path, fs-normalized
-	availability uint64 // availability bitset
+	path         string             // full path name, fs-normalized
+	temp         string             // temporary filename, full path, fs-normalized
+	availability files.Availability // nodes known to have this file
 	file         *os.File
-	err          error // error when opening or writing to file, all following operations are cancelled
-	outstanding  int   // number of requests we still have outstanding
-	done         bool  // we have sent all requests for this file
+	err          error           // error when opening or writing to file, all following operations are cancelled
+	outstanding  int             // number of requests we still have outstanding
+	done         bool            // we have sent all requests for this file
+	bytesDone    int64           // bytes written so far
+	bytesTotal   int64           // total size of the file
+	sources      map[string]bool // nodes (or "local") we have pulled blocks from
+}
+
+// Progress describes how far a single file pull has gotten, for eventual
+// reporting through Model's status API.
+type Progress struct {
+	Name    string
+	Bytes   int64
+	Total   int64
+	Sources []string
 }
 
 type activityMap map[string]int
 
-func (m activityMap) leastBusyNode(availability uint64, cm *cid.Map) string {
-	var low int = 2<<31 - 1
-	var selected string
-	for _, node := range cm.Names() {
-		id := cm.Get(node)
-		if id == cid.LocalID {
+func (m activityMap) decrease(node string) {
+	m[node]--
+}
+
+// throughputEWMA is the weight given to each new bandwidth sample when
+// updating a node's running average; lower values react more slowly.
+const throughputEWMA = 0.3
+
+// nodeStats tracks a decaying average of observed transfer speed per
+// node, so the scheduler can prefer fast nodes over slow ones.
+type nodeStats struct {
+	mut sync.Mutex
+	bps map[string]float64
+}
+
+func newNodeStats() *nodeStats {
+	return &nodeStats{bps: make(map[string]float64)}
+}
+
+func (s *nodeStats) sample(node string, bytes int, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(bytes) / elapsed.Seconds()
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if cur, ok := s.bps[node]; ok {
+		s.bps[node] = cur + throughputEWMA*(rate-cur)
+	} else {
+		s.bps[node] = rate
+	}
+}
+
+func (s *nodeStats) throughput(node string) float64 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.bps[node]
+}
+
+// Scheduler decides which file to pull next and which node to pull an
+// individual block from. rarestFirstScheduler is the default
+// implementation: it orders whole files by how many nodes are known to
+// have them, rarest first (similar in spirit to BitTorrent's rarest-first
+// piece picker, but at file rather than block granularity -- blocks
+// within one file, or across files queued in the same pass, aren't
+// individually reordered), and picks among eligible nodes by observed
+// throughput divided by current load.
+type Scheduler interface {
+	// Order sorts fs in the order files should be queued, rarest first.
+	Order(fs []scanner.File) []scanner.File
+	// SelectNode picks a node to serve the next block of f, given which
+	// nodes have the file, or "" if none are currently eligible.
+	SelectNode(f scanner.File, availability files.Availability) string
+}
+
+type rarestFirstScheduler struct {
+	p *puller
+}
+
+func newScheduler(p *puller) Scheduler {
+	return &rarestFirstScheduler{p: p}
+}
+
+type byAvailabilityCount struct {
+	files []scanner.File
+	p     *puller
+}
+
+func (a byAvailabilityCount) Len() int      { return len(a.files) }
+func (a byAvailabilityCount) Swap(i, j int) { a.files[i], a.files[j] = a.files[j], a.files[i] }
+
+// byAvailabilityCount sorts files rarest-first using the file's own
+// AvailabilityCount. This is a file-level proxy for rarity, not a
+// per-block one: a file with one rare block and many common ones is
+// ordered by its own count, not by whichever of its blocks is scarcest.
+func (a byAvailabilityCount) Less(i, j int) bool {
+	ci := a.p.model.fs.AvailabilityCount(a.files[i].Name)
+	cj := a.p.model.fs.AvailabilityCount(a.files[j].Name)
+	if ci == 0 {
+		// Nobody we know of has it (yet); don't let it jump the queue.
+		ci = 1 << 30
+	}
+	if cj == 0 {
+		cj = 1 << 30
+	}
+	return ci < cj
+}
+
+func (s *rarestFirstScheduler) Order(fs []scanner.File) []scanner.File {
+	sort.Sort(byAvailabilityCount{fs, s.p})
+	return fs
+}
+
+func (s *rarestFirstScheduler) SelectNode(f scanner.File, availability files.Availability) string {
+	var best string
+	var bestScore float64 = -1
+
+	for _, node := range s.p.model.cm.Names() {
+		id := s.p.model.cm.Get(node)
+		if id == cid.LocalID || !availability.Has(uint(id)) {
 			continue
 		}
-		usage := m[node]
-		if availability&(1<<id) != 0 {
-			if usage < low {
-				low = usage
-				selected = node
-			}
+		if s.p.nodeFailures[node] >= maxNodeFailures {
+			// This node has given us enough bad blocks in a row that
+			// we no longer trust it, for this or any other file.
+			continue
+		}
+		if s.p.oustandingPerNode[node] >= maxOutstandingPerNode {
+			continue
+		}
+
+		// Favour nodes with a higher observed throughput per request
+		// already outstanding against them; before we have any
+		// samples this reduces to picking the least busy one.
+		score := (s.p.stats.throughput(node) + 1) / float64(s.p.oustandingPerNode[node]+1)
+		if score > bestScore {
+			bestScore = score
+			best = node
 		}
 	}
-	m[selected]++
-	return selected
-}
 
-func (m activityMap) decrease(node string) {
-	m[node]--
+	if best != "" {
+		s.p.oustandingPerNode[best]++
+	}
+	return best
 }
 
 type puller struct {
@@ -61,7 +193,10 @@ type puller struct {
 	dir               string
 	bq                *blockQueue
 	model             *Model
+	scheduler         Scheduler
+	stats             *nodeStats
 	oustandingPerNode activityMap
+	nodeFailures      map[string]int
 	openFiles         map[string]openFile
 	requestSlots      chan bool
 	blocks            chan bqBlock
@@ -74,12 +209,15 @@ func newPuller(repo, dir string, model *Model, slots int) *puller {
 		dir:               dir,
 		bq:                newBlockQueue(),
 		model:             model,
+		stats:             newNodeStats(),
 		oustandingPerNode: make(activityMap),
+		nodeFailures:      make(map[string]int),
 		openFiles:         make(map[string]openFile),
 		requestSlots:      make(chan bool, slots),
 		blocks:            make(chan bqBlock),
 		requestResults:    make(chan requestResult),
 	}
+	p.scheduler = newScheduler(p)
 	for i := 0; i < slots; i++ {
 		p.requestSlots <- true
 	}
@@ -119,6 +257,11 @@ func (p *puller) run() {
 				if debugNeed || debugPull {
 					dlog.Printf("need: idle but have open files, not queueing more blocks\n  %#v", p.openFiles)
 				}
+				if debugPull {
+					for _, pr := range p.Progress() {
+						dlog.Printf("pull: progress %q %d/%d bytes, sources %v", pr.Name, pr.Bytes, pr.Total, pr.Sources)
+					}
+				}
 			} else {
 				p.queueNeededBlocks()
 			}
@@ -126,6 +269,12 @@ func (p *puller) run() {
 	}
 }
 
+// blockHashOK reports whether data hashes to the expected block hash.
+func blockHashOK(data, expected []byte) bool {
+	h := sha256.Sum256(data)
+	return bytes.Equal(h[:], expected)
+}
+
 func (p *puller) handleRequestResult(res requestResult) {
 	of, ok := p.openFiles[res.file.Name]
 	if !ok || of.err != nil {
@@ -133,12 +282,48 @@ func (p *puller) handleRequestResult(res requestResult) {
 		return
 	}
 
-	_, of.err = of.file.WriteAt(res.data, res.offset)
+	if res.err == nil && len(res.block.Hash) > 0 && !blockHashOK(res.data, res.block.Hash) {
+		res.err = errHashMismatch
+	}
+
+	if res.err != nil {
+		if res.err == errHashMismatch {
+			p.nodeFailures[res.node]++
+			if debugPull {
+				dlog.Printf("pull: %q offset %d: hash mismatch from %q (%d failures)", res.file.Name, res.block.Offset, res.node, p.nodeFailures[res.node])
+			}
+		}
+		buffers.Put(res.data)
+		of.outstanding--
+		p.openFiles[res.file.Name] = of
+
+		// Put the block back on the queue so it gets requested again.
+		// The scheduler does not avoid the node that just failed: it
+		// may be picked again until it reaches maxNodeFailures. We
+		// can't leave this to the next idle queueNeededBlocks pass: this
+		// file stays in openFiles (possibly already marked done, if this
+		// was its last block), and run's needTicker case skips
+		// queueNeededBlocks entirely as long as any file is open -- which
+		// this one now permanently is, unless we requeue here.
+		p.bq.put(bqAdd{
+			file: res.file,
+			need: []scanner.Block{res.block},
+		})
+		return
+	}
+
+	_, of.err = of.file.WriteAt(res.data, res.block.Offset)
+	of.bytesDone += int64(len(res.data))
 	buffers.Put(res.data)
 	of.outstanding--
 
+	// This node just proved itself good, so it gets a clean slate: a
+	// handful of bad blocks a while ago shouldn't keep excluding it from
+	// files it has nothing to do with.
+	delete(p.nodeFailures, res.node)
+
 	if debugPull {
-		dlog.Printf("pull: wrote %q offset %d outstanding %d done %v", res.file, res.offset, of.outstanding, of.done)
+		dlog.Printf("pull: wrote %q offset %d outstanding %d done %v", res.file, res.block.Offset, of.outstanding, of.done)
 	}
 
 	if of.done && of.outstanding == 0 {
@@ -147,12 +332,12 @@ func (p *puller) handleRequestResult(res requestResult) {
 		}
 		of.file.Close()
 		delete(p.openFiles, res.file.Name)
-		// TODO: Hash check
 		t := time.Unix(res.file.Modified, 0)
 		os.Chtimes(of.temp, t, t)
 		os.Chmod(of.temp, os.FileMode(res.file.Flags&0777))
 		os.Rename(of.temp, of.path)
 		p.model.fs.Update(cid.LocalID, []scanner.File{res.file})
+		return
 	}
 
 	p.openFiles[res.file.Name] = of
@@ -170,6 +355,8 @@ func (p *puller) handleBlock(b bqBlock) {
 		}
 		of.path = FSNormalize(path.Join(p.dir, f.Name))
 		of.temp = FSNormalize(path.Join(p.dir, defTempNamer.TempName(f.Name)))
+		of.bytesTotal = f.Size
+		of.sources = make(map[string]bool)
 
 		dirName := path.Dir(of.path)
 		_, err := os.Stat(dirName)
@@ -177,7 +364,14 @@ func (p *puller) handleBlock(b bqBlock) {
 			os.MkdirAll(dirName, 0777)
 		}
 
-		of.file, of.err = os.Create(of.temp)
+		// Open (without truncating) rather than always creating, so an
+		// interrupted transfer can resume from the bytes already on
+		// disk in the .tmp file instead of starting over.
+		var existed bool
+		if _, err := os.Stat(of.temp); err == nil {
+			existed = true
+		}
+		of.file, of.err = os.OpenFile(of.temp, os.O_RDWR|os.O_CREATE, 0644)
 		if of.err != nil {
 			if debugPull {
 				dlog.Printf("pull: %q: %v", f.Name, of.err)
@@ -186,6 +380,12 @@ func (p *puller) handleBlock(b bqBlock) {
 			p.requestSlots <- true
 			return
 		}
+		if existed {
+			of.bytesDone = p.resumeProgress(of.file, f.Blocks)
+			if debugPull {
+				dlog.Printf("pull: resuming %q, %d bytes already verified", f.Name, of.bytesDone)
+			}
+		}
 	}
 
 	if of.err != nil {
@@ -201,7 +401,7 @@ func (p *puller) handleBlock(b bqBlock) {
 		return
 	}
 
-	of.availability = uint64(p.model.fs.Availability(f.Name))
+	of.availability = p.model.fs.Availability(f.Name)
 	of.done = b.last
 
 	switch {
@@ -243,14 +443,38 @@ func (p *puller) handleBlock(b bqBlock) {
 				p.requestSlots <- true
 				return
 			}
+			of.bytesDone += b.Size
 		}
+		of.sources["local"] = true
 
 		exfd.Close()
 
 	case b.block.Size > 0:
+		// We may already have this block on disk from a previous,
+		// interrupted run of this same pull.
+		if blockOnDiskAt(of.file, b.block) {
+			if debugPull {
+				dlog.Printf("pull: %q offset %d already present on disk, skipping fetch", f.Name, b.block.Offset)
+			}
+			p.openFiles[f.Name] = of
+			p.requestSlots <- true
+			return
+		}
+
+		// Or it might already exist somewhere else in the local repo --
+		// a rename, a duplicate, or overlap with another version -- in
+		// which case we can copy it instead of fetching it.
+		if p.tryLocalCopy(of.file, b.block) {
+			of.bytesDone += b.block.Size
+			of.sources["local"] = true
+			p.openFiles[f.Name] = of
+			p.requestSlots <- true
+			return
+		}
+
 		// We have a block to get from the network
 
-		node := p.oustandingPerNode.leastBusyNode(of.availability, p.model.cm)
+		node := p.scheduler.SelectNode(f, of.availability)
 		if len(node) == 0 {
 			// There was no node available
 			p.requestSlots <- true
@@ -258,6 +482,7 @@ func (p *puller) handleBlock(b bqBlock) {
 		}
 
 		of.outstanding++
+		of.sources[node] = true
 		p.openFiles[f.Name] = of
 
 		go func(node string, b bqBlock) {
@@ -273,14 +498,18 @@ func (p *puller) handleBlock(b bqBlock) {
 				panic("wanted request from nonexistant node " + node)
 			}
 
+			t0 := time.Now()
 			bs, err := c.Request(p.repo, f.Name, b.block.Offset, int(b.block.Size))
+			if err == nil {
+				p.stats.sample(node, len(bs), time.Since(t0))
+			}
 			p.requestResults <- requestResult{
-				node:   node,
-				file:   f,
-				path:   of.path,
-				offset: b.block.Offset,
-				data:   bs,
-				err:    err,
+				node:  node,
+				file:  f,
+				path:  of.path,
+				block: b.block,
+				data:  bs,
+				err:   err,
 			}
 			p.requestSlots <- true
 		}(node, b)
@@ -308,8 +537,98 @@ func (p *puller) handleBlock(b bqBlock) {
 	}
 }
 
+// blockOnDiskAt reports whether fd already holds b's data at b's offset,
+// by hashing the bytes already present and comparing to b.Hash. Used to
+// resume an interrupted pull without re-fetching blocks we already have.
+func blockOnDiskAt(fd *os.File, b scanner.Block) bool {
+	if len(b.Hash) == 0 {
+		return false
+	}
+	buf := make([]byte, b.Size)
+	n, err := fd.ReadAt(buf, b.Offset)
+	if err != nil || n != int(b.Size) {
+		return false
+	}
+	return blockHashOK(buf, b.Hash)
+}
+
+// tryLocalCopy looks for a local file already known to hold the bytes
+// for block b (via the model's reverse block index) and, if one checks
+// out, copies them straight into dst instead of fetching them over the
+// network.
+func (p *puller) tryLocalCopy(dst *os.File, b scanner.Block) bool {
+	if len(b.Hash) == 0 {
+		return false
+	}
+
+	for _, src := range p.model.fs.BlockSources(b.Hash) {
+		buf, err := readLocalBlock(FSNormalize(path.Join(p.dir, src.Name)), src.Offset, b.Size)
+		if err != nil || !blockHashOK(buf, b.Hash) {
+			continue
+		}
+		if _, err := dst.WriteAt(buf, b.Offset); err != nil {
+			continue
+		}
+		if debugPull {
+			dlog.Printf("pull: reused block for offset %d from %q offset %d", b.Offset, src.Name, src.Offset)
+		}
+		return true
+	}
+
+	return false
+}
+
+func readLocalBlock(path string, offset, size int64) ([]byte, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	buf := make([]byte, size)
+	if _, err := fd.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// resumeProgress hashes every block of an existing .tmp file against the
+// blocks of the target version, returning the number of bytes that are
+// already correct on disk.
+func (p *puller) resumeProgress(fd *os.File, blocks []scanner.Block) int64 {
+	var done int64
+	for _, b := range blocks {
+		if blockOnDiskAt(fd, b) {
+			done += b.Size
+		}
+	}
+	return done
+}
+
+// Progress returns a snapshot of the current per-file pull progress.
+// Model doesn't yet have a status API to forward this to, so for now the
+// puller's own run loop is the only consumer, logging it under
+// debugPull; once Model grows that API it can call Progress() directly.
+func (p *puller) Progress() []Progress {
+	res := make([]Progress, 0, len(p.openFiles))
+	for name, of := range p.openFiles {
+		var sources []string
+		for s := range of.sources {
+			sources = append(sources, s)
+		}
+		res = append(res, Progress{
+			Name:    name,
+			Bytes:   of.bytesDone,
+			Total:   of.bytesTotal,
+			Sources: sources,
+		})
+	}
+	return res
+}
+
 func (p *puller) queueNeededBlocks() {
-	for _, f := range p.model.fs.Need(cid.LocalID) {
+	needed := p.scheduler.Order(p.model.fs.Need(cid.LocalID))
+	for _, f := range needed {
 		lf := p.model.fs.Get(cid.LocalID, f.Name)
 		have, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
 		if debugNeed {
@@ -0,0 +1,71 @@
+package files
+
+// Availability records which connection IDs have a given version of a
+// file. Unlike a fixed-width bitset it grows on demand, so meshes with
+// more than 64 peers behave the same as small ones.
+type Availability struct {
+	words []uint64
+}
+
+func (a *Availability) ensure(word int) {
+	for len(a.words) <= word {
+		a.words = append(a.words, 0)
+	}
+}
+
+// set marks id as having the file.
+func (a *Availability) set(id uint) {
+	w, b := id/64, id%64
+	a.ensure(int(w))
+	a.words[w] |= 1 << b
+}
+
+// Has reports whether id has the file.
+func (a Availability) Has(id uint) bool {
+	w, b := id/64, id%64
+	return int(w) < len(a.words) && a.words[w]&(1<<b) != 0
+}
+
+// Count returns the number of connection IDs that have the file.
+func (a Availability) Count() int {
+	var n int
+	for _, w := range a.words {
+		for w != 0 {
+			n += int(w & 1)
+			w >>= 1
+		}
+	}
+	return n
+}
+
+// Iter returns the connection IDs that have the file, in ascending order.
+func (a Availability) Iter() []uint {
+	var ids []uint
+	for wi, w := range a.words {
+		for b := uint(0); w != 0; b++ {
+			if w&1 != 0 {
+				ids = append(ids, uint(wi)*64+b)
+			}
+			w >>= 1
+		}
+	}
+	return ids
+}
+
+// clone returns an independent copy of a, so that mutating the copy's
+// bits never touches a's backing array.
+func (a Availability) clone() Availability {
+	words := make([]uint64, len(a.words))
+	copy(words, a.words)
+	return Availability{words: words}
+}
+
+// isZero reports whether no connection ID has the file.
+func (a Availability) isZero() bool {
+	for _, w := range a.words {
+		if w != 0 {
+			return false
+		}
+	}
+	return true
+}
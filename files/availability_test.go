@@ -0,0 +1,64 @@
+package files
+
+import "testing"
+
+func TestAvailabilitySetHasCount(t *testing.T) {
+	var a Availability
+	ids := []uint{0, 1, 63, 64, 130}
+	for _, id := range ids {
+		a.set(id)
+	}
+	for _, id := range ids {
+		if !a.Has(id) {
+			t.Errorf("Has(%d) = false, want true", id)
+		}
+	}
+	if a.Has(2) {
+		t.Error("Has(2) = true, want false")
+	}
+	if c := a.Count(); c != len(ids) {
+		t.Errorf("Count() = %d, want %d", c, len(ids))
+	}
+}
+
+func TestAvailabilityIter(t *testing.T) {
+	var a Availability
+	a.set(5)
+	a.set(70)
+	got := a.Iter()
+	want := []uint{5, 70}
+	if len(got) != len(want) {
+		t.Fatalf("Iter() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Iter() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestAvailabilityIsZero(t *testing.T) {
+	var a Availability
+	if !a.isZero() {
+		t.Error("fresh Availability should be zero")
+	}
+	a.set(40)
+	if a.isZero() {
+		t.Error("Availability with a bit set should not be zero")
+	}
+}
+
+func TestAvailabilityClone(t *testing.T) {
+	var a Availability
+	a.set(3)
+
+	b := a.clone()
+	b.set(100)
+
+	if a.Has(100) {
+		t.Error("mutating the clone should not affect the original")
+	}
+	if !b.Has(3) || !b.Has(100) {
+		t.Error("clone should retain the original's bits plus its own")
+	}
+}
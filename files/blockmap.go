@@ -0,0 +1,92 @@
+package files
+
+import "sync"
+
+// maxBlockMapEntries bounds how many distinct block hashes blockMap
+// remembers, so the reverse index doesn't grow without limit on large,
+// long-running repos.
+const maxBlockMapEntries = 1 << 16
+
+// blockMapEntry identifies a file and offset on local disk known to hold
+// the bytes for a particular block hash.
+type blockMapEntry struct {
+	file   string
+	offset int64
+	size   int64
+}
+
+// blockMap is a reverse index from block hash to the local files that
+// contain it, so that pulling a new file can reuse matching bytes found
+// anywhere in the local repo -- renames, duplicates, or partial content
+// in another file -- instead of fetching them over the network.
+type blockMap struct {
+	mut     sync.Mutex
+	entries map[string][]blockMapEntry
+	order   []string // hash keys in insertion order, for eviction
+}
+
+func newBlockMap() *blockMap {
+	return &blockMap{entries: make(map[string][]blockMapEntry)}
+}
+
+// Add records that hash can be found in file at offset/size.
+func (m *blockMap) Add(hash string, file string, offset, size int64) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if _, ok := m.entries[hash]; !ok {
+		m.order = append(m.order, hash)
+		for len(m.order) > maxBlockMapEntries {
+			oldest := m.order[0]
+			m.order = m.order[1:]
+			delete(m.entries, oldest)
+		}
+	}
+	m.entries[hash] = append(m.entries[hash], blockMapEntry{file, offset, size})
+}
+
+// Lookup returns the known locations of hash, if any.
+func (m *blockMap) Lookup(hash string) []blockMapEntry {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.entries[hash]
+}
+
+// Remove drops every entry recorded for file, for example before it is
+// rescanned or removed.
+func (m *blockMap) Remove(file string) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	var emptied map[string]bool
+	for hash, es := range m.entries {
+		kept := es[:0]
+		for _, e := range es {
+			if e.file != file {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.entries, hash)
+			if emptied == nil {
+				emptied = make(map[string]bool)
+			}
+			emptied[hash] = true
+		} else {
+			m.entries[hash] = kept
+		}
+	}
+
+	if emptied != nil {
+		// Keep order in sync with entries, otherwise a hash emptied here
+		// and re-Add()ed later ends up duplicated in order, making Add's
+		// eviction evict unrelated hashes before the map is actually full.
+		order := m.order[:0]
+		for _, h := range m.order {
+			if !emptied[h] {
+				order = append(order, h)
+			}
+		}
+		m.order = order
+	}
+}
@@ -0,0 +1,65 @@
+package files
+
+import "testing"
+
+func TestBlockMapAddLookup(t *testing.T) {
+	m := newBlockMap()
+	m.Add("hash1", "a.txt", 0, 128)
+	m.Add("hash1", "b.txt", 128, 128)
+
+	es := m.Lookup("hash1")
+	if len(es) != 2 {
+		t.Fatalf("Lookup(hash1) = %d entries, want 2", len(es))
+	}
+
+	if len(m.Lookup("missing")) != 0 {
+		t.Error("Lookup of an unknown hash should be empty")
+	}
+}
+
+func TestBlockMapRemove(t *testing.T) {
+	m := newBlockMap()
+	m.Add("hash1", "a.txt", 0, 128)
+	m.Add("hash2", "a.txt", 128, 128)
+	m.Add("hash2", "b.txt", 0, 128)
+
+	m.Remove("a.txt")
+
+	if len(m.Lookup("hash1")) != 0 {
+		t.Error("hash1 should have no entries left after removing a.txt")
+	}
+	es := m.Lookup("hash2")
+	if len(es) != 1 || es[0].file != "b.txt" {
+		t.Errorf("Lookup(hash2) = %v, want only b.txt's entry", es)
+	}
+}
+
+func TestBlockMapRemoveThenReAddDoesNotDuplicateOrder(t *testing.T) {
+	m := newBlockMap()
+	m.Add("hash1", "a.txt", 0, 128)
+	m.Remove("a.txt")
+	m.Add("hash1", "a.txt", 0, 128)
+
+	count := 0
+	for _, h := range m.order {
+		if h == "hash1" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("hash1 appears %d times in order, want 1", count)
+	}
+}
+
+func TestBlockMapEviction(t *testing.T) {
+	m := newBlockMap()
+	for i := 0; i < maxBlockMapEntries+10; i++ {
+		m.Add(string(rune(i)), "f", int64(i), 1)
+	}
+	if len(m.entries) > maxBlockMapEntries {
+		t.Errorf("entries = %d, want <= %d", len(m.entries), maxBlockMapEntries)
+	}
+	if len(m.order) > maxBlockMapEntries {
+		t.Errorf("order = %d, want <= %d", len(m.order), maxBlockMapEntries)
+	}
+}
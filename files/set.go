@@ -23,8 +23,6 @@ type fileRecord struct {
 	File  scanner.File
 }
 
-type bitset uint64
-
 func keyFor(f scanner.File) key {
 	h := md5.New()
 	for _, b := range f.Blocks {
@@ -55,43 +53,167 @@ func (a key) newerThan(b key) bool {
 
 type Set struct {
 	sync.Mutex
-	files              map[key]fileRecord
-	remoteKey          [64]map[string]key
-	changes            [64]uint64
-	globalAvailability map[string]bitset
+	store              Store
+	blocks             *blockMap
+	remoteKey          map[uint]map[string]key
+	globalAvailability map[string]Availability
 	globalKey          map[string]key
 }
 
+// NewSet returns a Set backed by memory only, matching the previous
+// behavior. The whole index lives in RAM and is lost on restart.
 func NewSet() *Set {
-	var m = Set{
-		files:              make(map[key]fileRecord),
-		globalAvailability: make(map[string]bitset),
+	return newSet(newMapStore())
+}
+
+// NewSetWithStore returns a Set backed by store. If store already holds
+// a local name table from a previous run, newSet rebuilds cid.LocalID's
+// entry in remoteKey (and the global view derived from it) from that
+// table, so a restart doesn't need a full local rescan to know the
+// local index again. The Lamport clock is seeded from the stored version
+// so that newly generated versions stay monotonic across the restart.
+//
+// Remote nodes aren't recovered this way -- Store only tracks ownership
+// for the local node -- so they still need to resync (send a fresh
+// Replace/Update) on reconnect.
+func NewSetWithStore(store Store) *Set {
+	m := newSet(store)
+	lamport.Seed(store.Version())
+	return m
+}
+
+func newSet(store Store) *Set {
+	m := &Set{
+		store:              store,
+		blocks:             newBlockMap(),
+		remoteKey:          make(map[uint]map[string]key),
+		globalAvailability: make(map[string]Availability),
 		globalKey:          make(map[string]key),
 	}
-	return &m
+
+	// Rebuild cid.LocalID's entry in remoteKey, and from it the global
+	// view, from the name -> key pairs Store recorded via PutLocal -- not
+	// from Cursor's content table, which has no owner of its own and also
+	// holds whatever remote nodes have sent us. This is a direct clone
+	// into the new indices (the same approach Migrate uses), not a
+	// replay through update()/replace(): those bump fileRecord.Usage for
+	// every name they see, which is correct when a remote is actually
+	// sending its index, but would inflate Usage on every single restart
+	// here since the content these names point to is already accounted
+	// for from the run that wrote it.
+	local := make(map[string]key)
+	store.LocalCursor(func(n string, k key) bool {
+		local[n] = k
+		return true
+	})
+	if len(local) > 0 {
+		m.remoteKey[cid.LocalID] = local
+		for n, fk := range local {
+			m.globalKey[n] = fk
+			var av Availability
+			av.set(cid.LocalID)
+			m.globalAvailability[n] = av
+
+			if r, ok := store.Get(fk); ok {
+				for _, b := range r.File.Blocks {
+					m.blocks.Add(string(b.Hash), n, b.Offset, b.Size)
+				}
+			}
+		}
+	}
+
+	return m
 }
 
-func (m *Set) Replace(id uint, fs []scanner.File) {
-	if id > 63 {
-		panic("Connection ID must be in the range 0 - 63 inclusive")
+// remoteKeyFor returns the name->key map for id, allocating it on first use.
+func (m *Set) remoteKeyFor(id uint) map[string]key {
+	rk, ok := m.remoteKey[id]
+	if !ok {
+		rk = make(map[string]key)
+		m.remoteKey[id] = rk
 	}
+	return rk
+}
 
+// Migrate copies the records held by m into store and returns a new Set
+// backed by it, letting an existing in-memory Set (for example one
+// created with NewSet) be promoted to a persistent backend without
+// losing its current index.
+func (m *Set) Migrate(store Store) *Set {
+	m.Lock()
+	defer m.Unlock()
+
+	m.store.Cursor(func(k key, r fileRecord) bool {
+		storeErr(store.Put(k, r))
+		return true
+	})
+	for n, fk := range m.remoteKey[cid.LocalID] {
+		storeErr(store.PutLocal(n, fk))
+	}
+	storeErr(store.SetVersion(m.store.Version()))
+	for id := range m.remoteKey {
+		storeErr(store.SetChanges(id, m.store.Changes(id)))
+	}
+
+	ns := newSet(store)
+
+	// remoteKey/globalKey/globalAvailability are plain maps guarded only
+	// by each Set's own Mutex, so ns needs its own copies rather than a
+	// share of m's -- otherwise a caller still holding a reference to m
+	// could mutate this state without ever taking ns's lock. blocks
+	// guards its own state with an internal mutex, so handing ns the
+	// same pointer is safe even with both Sets still in use.
+	ns.remoteKey = copyRemoteKey(m.remoteKey)
+	ns.globalAvailability = copyGlobalAvailability(m.globalAvailability)
+	ns.globalKey = copyGlobalKey(m.globalKey)
+	ns.blocks = m.blocks
+
+	lamport.Seed(store.Version())
+
+	return ns
+}
+
+func copyRemoteKey(src map[uint]map[string]key) map[uint]map[string]key {
+	dst := make(map[uint]map[string]key, len(src))
+	for id, rk := range src {
+		inner := make(map[string]key, len(rk))
+		for n, k := range rk {
+			inner[n] = k
+		}
+		dst[id] = inner
+	}
+	return dst
+}
+
+func copyGlobalKey(src map[string]key) map[string]key {
+	dst := make(map[string]key, len(src))
+	for n, k := range src {
+		dst[n] = k
+	}
+	return dst
+}
+
+func copyGlobalAvailability(src map[string]Availability) map[string]Availability {
+	dst := make(map[string]Availability, len(src))
+	for n, av := range src {
+		dst[n] = av.clone()
+	}
+	return dst
+}
+
+func (m *Set) Replace(id uint, fs []scanner.File) {
 	m.Lock()
 	if !m.equals(id, fs) {
-		m.changes[id]++
+		m.bumpChanges(id)
 		m.replace(id, fs)
 	}
 	m.Unlock()
 }
 
 func (m *Set) ReplaceWithDelete(id uint, fs []scanner.File) {
-	if id > 63 {
-		panic("Connection ID must be in the range 0 - 63 inclusive")
-	}
-
 	m.Lock()
 	if !m.equals(id, fs) {
-		m.changes[id]++
+		m.bumpChanges(id)
 
 		var nf = make(map[string]key, len(fs))
 		for _, f := range fs {
@@ -103,7 +225,8 @@ func (m *Set) ReplaceWithDelete(id uint, fs []scanner.File) {
 
 		for _, ck := range m.remoteKey[cid.LocalID] {
 			if _, ok := nf[ck.Name]; !ok {
-				cf := m.files[ck].File
+				cr, _ := m.store.Get(ck)
+				cf := cr.File
 				cf.Flags = protocol.FlagDeleted
 				cf.Blocks = nil
 				cf.Size = 0
@@ -123,7 +246,7 @@ func (m *Set) ReplaceWithDelete(id uint, fs []scanner.File) {
 func (m *Set) Update(id uint, fs []scanner.File) {
 	m.Lock()
 	m.update(id, fs)
-	m.changes[id]++
+	m.bumpChanges(id)
 	m.Unlock()
 }
 
@@ -132,7 +255,9 @@ func (m *Set) Need(cid uint) []scanner.File {
 	m.Lock()
 	for name, gk := range m.globalKey {
 		if gk.newerThan(m.remoteKey[cid][name]) {
-			fs = append(fs, m.files[gk].File)
+			if r, ok := m.store.Get(gk); ok {
+				fs = append(fs, r.File)
+			}
 		}
 	}
 	m.Unlock()
@@ -143,7 +268,9 @@ func (m *Set) Have(cid uint) []scanner.File {
 	var fs []scanner.File
 	m.Lock()
 	for _, rk := range m.remoteKey[cid] {
-		fs = append(fs, m.files[rk].File)
+		if r, ok := m.store.Get(rk); ok {
+			fs = append(fs, r.File)
+		}
 	}
 	m.Unlock()
 	return fs
@@ -153,7 +280,9 @@ func (m *Set) Global() []scanner.File {
 	var fs []scanner.File
 	m.Lock()
 	for _, rk := range m.globalKey {
-		fs = append(fs, m.files[rk].File)
+		if r, ok := m.store.Get(rk); ok {
+			fs = append(fs, r.File)
+		}
 	}
 	m.Unlock()
 	return fs
@@ -162,25 +291,83 @@ func (m *Set) Global() []scanner.File {
 func (m *Set) Get(cid uint, file string) scanner.File {
 	m.Lock()
 	defer m.Unlock()
-	return m.files[m.remoteKey[cid][file]].File
+	r, _ := m.store.Get(m.remoteKey[cid][file])
+	return r.File
 }
 
 func (m *Set) GetGlobal(file string) scanner.File {
 	m.Lock()
 	defer m.Unlock()
-	return m.files[m.globalKey[file]].File
+	r, _ := m.store.Get(m.globalKey[file])
+	return r.File
 }
 
-func (m *Set) Availability(name string) bitset {
+func (m *Set) Availability(name string) Availability {
 	m.Lock()
 	defer m.Unlock()
 	return m.globalAvailability[name]
 }
 
+// AvailabilityCount returns the number of nodes known to have name, for
+// rarest-first scheduling of pulls.
+func (m *Set) AvailabilityCount(name string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.globalAvailability[name].Count()
+}
+
+// LocalBlockSource identifies a file and offset on local disk known to
+// hold the bytes for a particular block.
+type LocalBlockSource struct {
+	Name   string
+	Offset int64
+	Size   int64
+}
+
+// BlockSources returns the local files known to already contain a block
+// with the given hash, so a puller can copy them instead of fetching the
+// block over the network.
+func (m *Set) BlockSources(hash []byte) []LocalBlockSource {
+	m.Lock()
+	defer m.Unlock()
+
+	es := m.blocks.Lookup(string(hash))
+	if len(es) == 0 {
+		return nil
+	}
+	srcs := make([]LocalBlockSource, len(es))
+	for i, e := range es {
+		srcs[i] = LocalBlockSource{Name: e.file, Offset: e.offset, Size: e.size}
+	}
+	return srcs
+}
+
 func (m *Set) Changes(id uint) uint64 {
 	m.Lock()
 	defer m.Unlock()
-	return m.changes[id]
+	return m.store.Changes(id)
+}
+
+func (m *Set) bumpChanges(id uint) {
+	storeErr(m.store.SetChanges(id, m.store.Changes(id)+1))
+}
+
+// bumpVersion records v as the newest version ever observed, so it can
+// be handed back to the Lamport clock on the next restart.
+func (m *Set) bumpVersion(v uint64) {
+	if v > m.store.Version() {
+		storeErr(m.store.SetVersion(v))
+	}
+}
+
+// storeErr logs a failed Store write. A failed persist doesn't break the
+// in-memory index Set is already serving from, but it does mean the
+// change may be gone again on the next restart, so it's always surfaced
+// rather than dropped.
+func storeErr(err error) {
+	if err != nil {
+		dlog.Println("files: store error:", err)
+	}
 }
 
 func (m *Set) equals(id uint, fs []scanner.File) bool {
@@ -196,28 +383,50 @@ func (m *Set) equals(id uint, fs []scanner.File) bool {
 	return true
 }
 
-func (m *Set) update(cid uint, fs []scanner.File) {
-	remFiles := m.remoteKey[cid]
+func (m *Set) update(id uint, fs []scanner.File) {
+	remFiles := m.remoteKeyFor(id)
+	local := id == cid.LocalID
 	for _, f := range fs {
 		n := f.Name
 		fk := keyFor(f)
+		m.bumpVersion(fk.Version)
 
-		if ck, ok := remFiles[n]; ok && ck == fk {
+		ck, known := remFiles[n]
+		if known && ck == fk {
 			// The remote already has exactly this file, skip it
 			continue
 		}
 
 		remFiles[n] = fk
 
+		if local {
+			// Keep Store's local name table in sync, so a restart can
+			// rebuild remoteKey[cid.LocalID] without having to trust the
+			// shared content table's ownership.
+			storeErr(m.store.PutLocal(n, fk))
+		}
+
 		// Keep the block list or increment the usage
-		if br, ok := m.files[fk]; !ok {
-			m.files[fk] = fileRecord{
+		if br, ok := m.store.Get(fk); !ok {
+			storeErr(m.store.Put(fk, fileRecord{
 				Usage: 1,
 				File:  f,
-			}
+			}))
 		} else {
 			br.Usage++
-			m.files[fk] = br
+			storeErr(m.store.Put(fk, br))
+		}
+
+		if local {
+			// Refresh the reverse block index so other pulls can reuse
+			// bytes that already live in this file on disk. A brand new
+			// name has nothing to remove, so skip the scan for it.
+			if known {
+				m.blocks.Remove(n)
+			}
+			for _, b := range f.Blocks {
+				m.blocks.Add(string(b.Hash), n, b.Offset, b.Size)
+			}
 		}
 
 		// Update global view
@@ -225,50 +434,66 @@ func (m *Set) update(cid uint, fs []scanner.File) {
 		switch {
 		case ok && fk == gk:
 			av := m.globalAvailability[n]
-			av |= 1 << cid
+			av.set(id)
 			m.globalAvailability[n] = av
 		case fk.newerThan(gk):
 			m.globalKey[n] = fk
-			m.globalAvailability[n] = 1 << cid
+			var av Availability
+			av.set(id)
+			m.globalAvailability[n] = av
 		}
 	}
 }
 
-func (m *Set) replace(cid uint, fs []scanner.File) {
+func (m *Set) replace(id uint, fs []scanner.File) {
+	local := id == cid.LocalID
+
+	// Snapshot the local names we knew about before this replace, so we
+	// can tell afterwards which ones dropped out entirely and need to be
+	// forgotten from Store's local table too.
+	var oldLocalNames map[string]key
+	if local {
+		oldLocalNames = m.remoteKey[id]
+	}
+
 	// Decrement usage for all files belonging to this remote, and remove
 	// those that are no longer needed.
-	for _, fk := range m.remoteKey[cid] {
-		br, ok := m.files[fk]
+	for _, fk := range m.remoteKey[id] {
+		if local {
+			m.blocks.Remove(fk.Name)
+		}
+		br, ok := m.store.Get(fk)
 		switch {
 		case ok && br.Usage == 1:
-			delete(m.files, fk)
+			storeErr(m.store.Delete(fk))
 		case ok && br.Usage > 1:
 			br.Usage--
-			m.files[fk] = br
+			storeErr(m.store.Put(fk, br))
 		}
 	}
 
 	// Clear existing remote remoteKey
-	m.remoteKey[cid] = make(map[string]key)
+	m.remoteKey[id] = make(map[string]key)
 
 	// Recalculate global based on all remaining remoteKey
 	for n := range m.globalKey {
-		var nk key    // newest key
-		var na bitset // newest availability
+		var nk key          // newest key
+		var na Availability // newest availability
 
 		for i, rem := range m.remoteKey {
 			if rk, ok := rem[n]; ok {
 				switch {
 				case rk == nk:
-					na |= 1 << uint(i)
+					na.set(i)
 				case rk.newerThan(nk):
 					nk = rk
-					na = 1 << uint(i)
+					na = Availability{}
+					na.set(i)
 				}
 			}
 		}
 
-		if na != 0 {
+		if !na.isZero() {
 			// Someone had the file
 			m.globalKey[n] = nk
 			m.globalAvailability[n] = na
@@ -280,5 +505,17 @@ func (m *Set) replace(cid uint, fs []scanner.File) {
 	}
 
 	// Add new remote remoteKey to the mix
-	m.update(cid, fs)
+	m.update(id, fs)
+
+	if local {
+		// Anything that was in the old local set but didn't come back in
+		// fs is gone for good (as opposed to ReplaceWithDelete, which
+		// keeps the name around with FlagDeleted set) -- forget it in
+		// Store's local table as well.
+		for n := range oldLocalNames {
+			if _, ok := m.remoteKey[id][n]; !ok {
+				storeErr(m.store.DeleteLocal(n))
+			}
+		}
+	}
 }
@@ -0,0 +1,351 @@
+package files
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	bucketRecords = []byte("records")
+	bucketMeta    = []byte("meta")
+	bucketLocal   = []byte("local")
+	metaVersion   = []byte("version")
+)
+
+// Store is the persistence backend for a Set. It holds the content
+// addressed fileRecords (the part of the index that grows with repo size),
+// the local node's own name -> key ownership table, plus the bits of
+// bookkeeping -- the Lamport version and the per-node change counters --
+// that need to survive a restart.
+//
+// The content table is shared and carries no owner information: the same
+// record can be referenced by any number of remote nodes as well as by
+// the local node, and Get/Cursor can't tell which. The local table exists
+// precisely to answer that question for cid.LocalID -- it is the only
+// part of remoteKey that actually needs to survive a restart, since
+// remote nodes re-announce their own index on reconnect.
+//
+// The write methods return an error instead of failing silently, since a
+// Store exists specifically so state survives a restart: a caller that
+// ignores a failed Put or SetVersion would be worse off than if it had
+// never bothered to persist at all.
+//
+// Set does its own locking around Store calls, so implementations do not
+// need to be safe for concurrent use on their own.
+type Store interface {
+	Get(k key) (fileRecord, bool)
+	Put(k key, r fileRecord) error
+	Delete(k key) error
+	// Cursor calls fn for every stored record, in unspecified order,
+	// until fn returns false.
+	Cursor(fn func(k key, r fileRecord) bool)
+
+	// PutLocal records that name is one of the local node's own files,
+	// currently at key k.
+	PutLocal(name string, k key) error
+	// DeleteLocal forgets that name is one of the local node's own files.
+	DeleteLocal(name string) error
+	// LocalCursor calls fn for every name recorded via PutLocal, in
+	// unspecified order, until fn returns false.
+	LocalCursor(fn func(name string, k key) bool)
+
+	Version() uint64
+	SetVersion(v uint64) error
+
+	Changes(id uint) uint64
+	SetChanges(id uint, v uint64) error
+
+	Close() error
+}
+
+// mapStore is the default, memory only Store used by NewSet. It has the
+// same characteristics as the old hardcoded map[key]fileRecord, so its
+// writes never fail.
+type mapStore struct {
+	files   map[key]fileRecord
+	version uint64
+	changes map[uint]uint64
+	local   map[string]key
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{
+		files:   make(map[key]fileRecord),
+		changes: make(map[uint]uint64),
+		local:   make(map[string]key),
+	}
+}
+
+func (s *mapStore) Get(k key) (fileRecord, bool) {
+	r, ok := s.files[k]
+	return r, ok
+}
+
+func (s *mapStore) Put(k key, r fileRecord) error {
+	s.files[k] = r
+	return nil
+}
+
+func (s *mapStore) Delete(k key) error {
+	delete(s.files, k)
+	return nil
+}
+
+func (s *mapStore) Cursor(fn func(k key, r fileRecord) bool) {
+	for k, r := range s.files {
+		if !fn(k, r) {
+			return
+		}
+	}
+}
+
+func (s *mapStore) PutLocal(name string, k key) error {
+	s.local[name] = k
+	return nil
+}
+
+func (s *mapStore) DeleteLocal(name string) error {
+	delete(s.local, name)
+	return nil
+}
+
+func (s *mapStore) LocalCursor(fn func(name string, k key) bool) {
+	for n, k := range s.local {
+		if !fn(n, k) {
+			return
+		}
+	}
+}
+
+func (s *mapStore) Version() uint64 {
+	return s.version
+}
+
+func (s *mapStore) SetVersion(v uint64) error {
+	s.version = v
+	return nil
+}
+
+func (s *mapStore) Changes(id uint) uint64 {
+	return s.changes[id]
+}
+
+func (s *mapStore) SetChanges(id uint, v uint64) error {
+	s.changes[id] = v
+	return nil
+}
+
+func (s *mapStore) Close() error {
+	return nil
+}
+
+// boltStore persists fileRecords in a BoltDB database, so that a Set can
+// be reopened after a restart without a full rescan of the repo.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (creating if necessary) a BoltDB backed Store at
+// path. The returned Store is suitable for use with NewSetWithStore.
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketRecords); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(bucketMeta); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketLocal)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func encodeKey(k key) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(k); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeKey(b []byte) (key, error) {
+	var k key
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&k)
+	return k, err
+}
+
+func encodeRecord(r fileRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRecord(b []byte) (fileRecord, error) {
+	var r fileRecord
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&r)
+	return r, err
+}
+
+func (s *boltStore) Get(k key) (fileRecord, bool) {
+	kb, err := encodeKey(k)
+	if err != nil {
+		dlog.Println("files: encode key failed:", err)
+		return fileRecord{}, false
+	}
+
+	var r fileRecord
+	var found bool
+	s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketRecords).Get(kb)
+		if v == nil {
+			return nil
+		}
+		rec, err := decodeRecord(v)
+		if err != nil {
+			dlog.Println("files: decode record failed:", err)
+			return nil
+		}
+		r, found = rec, true
+		return nil
+	})
+	return r, found
+}
+
+func (s *boltStore) Put(k key, r fileRecord) error {
+	kb, err := encodeKey(k)
+	if err != nil {
+		return err
+	}
+	rb, err := encodeRecord(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRecords).Put(kb, rb)
+	})
+}
+
+func (s *boltStore) Delete(k key) error {
+	kb, err := encodeKey(k)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRecords).Delete(kb)
+	})
+}
+
+func (s *boltStore) Cursor(fn func(k key, r fileRecord) bool) {
+	s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketRecords).Cursor()
+		for kb, vb := c.First(); kb != nil; kb, vb = c.Next() {
+			k, err := decodeKey(kb)
+			if err != nil {
+				dlog.Println("files: decode key failed:", err)
+				continue
+			}
+			r, err := decodeRecord(vb)
+			if err != nil {
+				dlog.Println("files: decode record failed:", err)
+				continue
+			}
+			if !fn(k, r) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) PutLocal(name string, k key) error {
+	kb, err := encodeKey(k)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLocal).Put([]byte(name), kb)
+	})
+}
+
+func (s *boltStore) DeleteLocal(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLocal).Delete([]byte(name))
+	})
+}
+
+func (s *boltStore) LocalCursor(fn func(name string, k key) bool) {
+	s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketLocal).Cursor()
+		for nb, kb := c.First(); nb != nil; nb, kb = c.Next() {
+			k, err := decodeKey(kb)
+			if err != nil {
+				dlog.Println("files: decode local key failed:", err)
+				continue
+			}
+			if !fn(string(nb), k) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) metaUint64(k []byte) uint64 {
+	var v uint64
+	s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketMeta).Get(k); len(b) == 8 {
+			v = binary.BigEndian.Uint64(b)
+		}
+		return nil
+	})
+	return v
+}
+
+func (s *boltStore) setMetaUint64(k []byte, v uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		return tx.Bucket(bucketMeta).Put(k, b)
+	})
+}
+
+func (s *boltStore) Version() uint64 {
+	return s.metaUint64(metaVersion)
+}
+
+func (s *boltStore) SetVersion(v uint64) error {
+	return s.setMetaUint64(metaVersion, v)
+}
+
+func changesMetaKey(id uint) []byte {
+	return []byte(fmt.Sprintf("changes-%d", id))
+}
+
+func (s *boltStore) Changes(id uint) uint64 {
+	return s.metaUint64(changesMetaKey(id))
+}
+
+func (s *boltStore) SetChanges(id uint, v uint64) error {
+	return s.setMetaUint64(changesMetaKey(id), v)
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
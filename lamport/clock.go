@@ -17,3 +17,15 @@ func Clock(c uint64) uint64 {
 		return clockVal
 	}
 }
+
+// Seed fast-forwards the clock to v, unless it is already further ahead.
+// Unlike Clock it does not tick the value, so it's safe to call with a
+// version recovered from persisted state without perturbing ongoing
+// comparisons. Used to restore continuity across restarts.
+func Seed(v uint64) {
+	clockMut.Lock()
+	if v > clockVal {
+		clockVal = v
+	}
+	clockMut.Unlock()
+}